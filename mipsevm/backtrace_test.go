@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// synthSourceMap builds a SourceMap where each S index maps to a distinct,
+// easily-recognized line number, so a test can assert Backtrace() ordering
+// by comparing lines instead of having to track frame identity by hand.
+func synthSourceMap(instrs []InstrMapping) *SourceMap {
+	posData := make([]LineCol, 0, len(instrs))
+	for i := range instrs {
+		posData = append(posData, LineCol{Line: uint32((i + 1) * 10), Col: 0})
+	}
+	return &SourceMap{
+		Sources: []string{"a.sol"},
+		PosData: [][]LineCol{posData},
+		Instr:   instrs,
+	}
+}
+
+func newTestTracer(srcMap *SourceMap) *SourceMapTracer {
+	tr := srcMap.Tracer(io.Discard)
+	tr.CaptureStart(nil, common.Address{}, common.Address{}, false, nil, 0, big.NewInt(0))
+	return tr
+}
+
+func linesOf(frames []Frame) []uint32 {
+	lines := make([]uint32, len(frames))
+	for i, f := range frames {
+		lines[i] = f.Line
+	}
+	return lines
+}
+
+func equalLines(a, b []uint32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// TestBacktraceNestedInternalCalls checks that J=='i'/'o' push and pop
+// frames in order within a single message call, so Backtrace reports
+// outermost-to-innermost nesting of internal (JUMP-based) function calls.
+func TestBacktraceNestedInternalCalls(t *testing.T) {
+	// pc0: line10, regular instruction
+	// pc1: line20, jump into internal function A
+	// pc2: line30, inside A, jump into nested internal function B
+	// pc3: line40, inside B
+	srcMap := synthSourceMap([]InstrMapping{
+		{S: 0, F: 0, J: '-'},
+		{S: 1, F: 0, J: 'i'},
+		{S: 2, F: 0, J: 'i'},
+		{S: 3, F: 0, J: '-'},
+	})
+	tr := newTestTracer(srcMap)
+
+	tr.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+	tr.CaptureState(1, vm.STOP, 0, 0, nil, nil, 0, nil)
+	tr.CaptureState(2, vm.STOP, 0, 0, nil, nil, 0, nil)
+
+	got := linesOf(tr.Backtrace(3))
+	want := []uint32{20, 30, 40} // frame A (pushed at pc1), frame B (pushed at pc2), current pc3
+	if !equalLines(got, want) {
+		t.Fatalf("Backtrace lines = %v, want %v", got, want)
+	}
+}
+
+// TestBacktracePopUnwindsInternalCalls checks that a J=='o' instruction
+// pops the most recently pushed internal frame, so once function B
+// returns, B's frame no longer appears under Backtrace.
+func TestBacktracePopUnwindsInternalCalls(t *testing.T) {
+	// pc0: line10, jump into A
+	// pc1: line20, jump into B
+	// pc2: line30, inside B
+	// pc3: line40, jump out of B back into A
+	srcMap := synthSourceMap([]InstrMapping{
+		{S: 0, F: 0, J: 'i'},
+		{S: 1, F: 0, J: 'i'},
+		{S: 2, F: 0, J: '-'},
+		{S: 3, F: 0, J: 'o'},
+	})
+	tr := newTestTracer(srcMap)
+
+	tr.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+	tr.CaptureState(1, vm.STOP, 0, 0, nil, nil, 0, nil)
+	tr.CaptureState(2, vm.STOP, 0, 0, nil, nil, 0, nil)
+	tr.CaptureState(3, vm.STOP, 0, 0, nil, nil, 0, nil)
+
+	got := linesOf(tr.Backtrace(3))
+	want := []uint32{10, 40} // only A's frame remains, plus the current (popping) instruction
+	if !equalLines(got, want) {
+		t.Fatalf("Backtrace lines = %v, want %v", got, want)
+	}
+}
+
+// TestBacktraceExtraPopIsNoop checks that a stray J=='o' with no
+// corresponding open frame (malformed or adversarial bytecode) doesn't
+// panic and leaves the frame stack untouched, rather than underflowing it.
+func TestBacktraceExtraPopIsNoop(t *testing.T) {
+	srcMap := synthSourceMap([]InstrMapping{
+		{S: 0, F: 0, J: 'o'},
+	})
+	tr := newTestTracer(srcMap)
+
+	tr.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+
+	got := linesOf(tr.Backtrace(0))
+	want := []uint32{10} // nothing to pop; just the current instruction's own frame
+	if !equalLines(got, want) {
+		t.Fatalf("Backtrace lines = %v, want %v", got, want)
+	}
+}
+
+// TestBacktraceExitDropsCallScopeFrames checks that internal frames pushed
+// inside one EVM message call (between CaptureEnter and CaptureExit) do
+// not leak into the caller's Backtrace once that call returns or reverts:
+// CaptureExit must drop the whole inner callScope, not just rely on
+// matching 'i'/'o' pairs that a revert may have cut short.
+func TestBacktraceExitDropsCallScopeFrames(t *testing.T) {
+	// Outer scope: jump into function A at line20.
+	outer := synthSourceMap([]InstrMapping{
+		{S: 0, F: 0, J: '-'},
+		{S: 1, F: 0, J: 'i'},
+	})
+	tr := newTestTracer(outer)
+	tr.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+	tr.CaptureState(1, vm.STOP, 0, 0, nil, nil, 0, nil)
+
+	// A CALL opens a new message frame; the callee jumps into its own
+	// internal function without ever returning from it (e.g. it reverts).
+	tr.CaptureEnter(vm.CALL, common.Address{}, common.Address{}, nil, 0, big.NewInt(0))
+	callee := &SourceMap{
+		Sources: []string{"b.sol"},
+		PosData: [][]LineCol{{{Line: 50, Col: 0}}},
+		Instr:   []InstrMapping{{S: 0, F: 0, J: 'i'}},
+	}
+	tr.srcMap = callee
+	tr.CaptureState(0, vm.STOP, 0, 0, nil, nil, 0, nil)
+
+	// scope0's open frame (20), scope1's open frame (50), and the current
+	// pc's own frame (50 again, since pc0 is itself the J=='i' instruction).
+	if got := linesOf(tr.Backtrace(0)); !equalLines(got, []uint32{20, 50, 50}) {
+		t.Fatalf("Backtrace inside call = %v, want [20 50 50]", got)
+	}
+
+	// The call reverts: CaptureExit must discard the callee's frame
+	// entirely, regardless of whether it ever hit a matching 'o'.
+	tr.CaptureExit(nil, 0, nil)
+	tr.srcMap = outer
+
+	if got := linesOf(tr.Backtrace(1)); !equalLines(got, []uint32{20, 20}) {
+		t.Fatalf("Backtrace after CaptureExit = %v, want [20 20] (callee frame dropped)", got)
+	}
+}
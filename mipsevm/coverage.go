@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// lineKey identifies a single source line by file index (into SourceMap.Sources)
+// and 1-based line number.
+type lineKey struct {
+	file int32
+	line uint32
+}
+
+// branchKey identifies a jump-type branch point (a J == 'i'/'o' instruction)
+// by the source position it originates from.
+type branchKey struct {
+	file int32
+	line uint32
+	col  uint32
+}
+
+// Coverage accumulates per-pc execution counts, bucketed onto source
+// lines and jump-type branch points via a SourceMap.
+type Coverage struct {
+	srcMap     *SourceMap
+	lineHits   map[lineKey]uint64
+	branchHits map[branchKey]uint64
+}
+
+func NewCoverage(srcMap *SourceMap) *Coverage {
+	return &Coverage{
+		srcMap:     srcMap,
+		lineHits:   make(map[lineKey]uint64),
+		branchHits: make(map[branchKey]uint64),
+	}
+}
+
+// Hit records that the instruction at pc executed once, crediting its
+// source line, and its branch point if it is a jump into/out of a function.
+func (c *Coverage) Hit(pc uint64) {
+	instr := c.srcMap.Instr[pc]
+	if instr.F < 0 || int(instr.F) >= len(c.srcMap.Sources) || c.srcMap.PosData[instr.F] == nil || instr.S < 0 {
+		return
+	}
+	_, line, col := c.srcMap.Info(pc)
+	c.lineHits[lineKey{file: instr.F, line: line}]++
+	if instr.J == 'i' || instr.J == 'o' {
+		c.branchHits[branchKey{file: instr.F, line: line, col: col}]++
+	}
+}
+
+// Merge folds the counts of other into c. Both must be derived from the
+// same SourceMap (or at least one with identical file indices).
+func (c *Coverage) Merge(other *Coverage) {
+	for k, v := range other.lineHits {
+		c.lineHits[k] += v
+	}
+	for k, v := range other.branchHits {
+		c.branchHits[k] += v
+	}
+}
+
+// knownLines returns, per file index, the set of source lines that the
+// SourceMap is capable of attributing bytecode to, so WriteLCOV can report
+// LF/LH for lines that were never hit as well as lines that were.
+func (c *Coverage) knownLines() map[int32]map[uint32]bool {
+	out := make(map[int32]map[uint32]bool)
+	for pc, instr := range c.srcMap.Instr {
+		if instr.F < 0 || int(instr.F) >= len(c.srcMap.Sources) || c.srcMap.PosData[instr.F] == nil || instr.S < 0 {
+			continue
+		}
+		_, line, _ := c.srcMap.Info(uint64(pc))
+		lines, ok := out[instr.F]
+		if !ok {
+			lines = make(map[uint32]bool)
+			out[instr.F] = lines
+		}
+		lines[line] = true
+	}
+	return out
+}
+
+// knownBranches returns, per file index, the set of jump-type (J == 'i' or
+// 'o') branch points the SourceMap knows about, regardless of whether they
+// were ever executed — mirroring knownLines, so WriteLCOV/WriteJSON can
+// report a branch as found-but-not-hit instead of omitting it entirely.
+func (c *Coverage) knownBranches() map[int32]map[branchKey]bool {
+	out := make(map[int32]map[branchKey]bool)
+	for pc, instr := range c.srcMap.Instr {
+		if instr.F < 0 || int(instr.F) >= len(c.srcMap.Sources) || c.srcMap.PosData[instr.F] == nil || instr.S < 0 {
+			continue
+		}
+		if instr.J != 'i' && instr.J != 'o' {
+			continue
+		}
+		_, line, col := c.srcMap.Info(uint64(pc))
+		branches, ok := out[instr.F]
+		if !ok {
+			branches = make(map[branchKey]bool)
+			out[instr.F] = branches
+		}
+		branches[branchKey{file: instr.F, line: line, col: col}] = true
+	}
+	return out
+}
+
+// WriteLCOV writes an LCOV tracefile: one SF/DA*/BRDA*/LH/LF/BRF/BRH record
+// set per source file, skipping files whose PosData is nil (sources
+// prefixed with "~", i.e. known to be unavailable).
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	known := c.knownLines()
+	knownBranches := c.knownBranches()
+	for file, lines := range known {
+		fmt.Fprintf(w, "SF:%s\n", c.srcMap.Sources[file])
+
+		lineNums := make([]uint32, 0, len(lines))
+		for l := range lines {
+			lineNums = append(lineNums, l)
+		}
+		sort.Slice(lineNums, func(i, j int) bool { return lineNums[i] < lineNums[j] })
+
+		linesHit := 0
+		for _, l := range lineNums {
+			count := c.lineHits[lineKey{file: file, line: l}]
+			if count > 0 {
+				linesHit++
+			}
+			fmt.Fprintf(w, "DA:%d,%d\n", l, count)
+		}
+
+		branchesFound, branchesHit := 0, 0
+		for k := range knownBranches[file] {
+			count := c.branchHits[k]
+			branchesFound++
+			if count > 0 {
+				branchesHit++
+			}
+			fmt.Fprintf(w, "BRDA:%d,0,%d,%s\n", k.line, k.col, brdaCount(count))
+		}
+
+		fmt.Fprintf(w, "LH:%d\n", linesHit)
+		fmt.Fprintf(w, "LF:%d\n", len(lineNums))
+		if branchesFound > 0 {
+			fmt.Fprintf(w, "BRH:%d\n", branchesHit)
+			fmt.Fprintf(w, "BRF:%d\n", branchesFound)
+		}
+		fmt.Fprintln(w, "end_of_record")
+	}
+	return nil
+}
+
+func brdaCount(count uint64) string {
+	if count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", count)
+}
+
+// coverageFileJSON is the per-file shape written by WriteJSON.
+type coverageFileJSON struct {
+	Source   string            `json:"source"`
+	Lines    map[uint32]uint64 `json:"lines"`
+	Branches map[string]uint64 `json:"branches"`
+}
+
+// WriteJSON writes a structured coverage report, one entry per source
+// file, suitable for tooling that does not consume LCOV directly.
+func (c *Coverage) WriteJSON(w io.Writer) error {
+	known := c.knownLines()
+	knownBranches := c.knownBranches()
+	files := make([]coverageFileJSON, 0, len(known))
+	for file, lines := range known {
+		f := coverageFileJSON{
+			Source:   c.srcMap.Sources[file],
+			Lines:    make(map[uint32]uint64, len(lines)),
+			Branches: make(map[string]uint64),
+		}
+		for l := range lines {
+			f.Lines[l] = c.lineHits[lineKey{file: file, line: l}]
+		}
+		for k := range knownBranches[file] {
+			f.Branches[fmt.Sprintf("%d:%d", k.line, k.col)] = c.branchHits[k]
+		}
+		files = append(files, f)
+	}
+	enc := json.NewEncoder(w)
+	return enc.Encode(files)
+}
+
+// CoverageTracer is an vm.EVMLogger that records coverage instead of
+// printing a trace, for use in CI runs of contract test suites.
+type CoverageTracer struct {
+	srcMap   *SourceMap
+	Coverage *Coverage
+}
+
+func (s *SourceMap) CoverageTracer() *CoverageTracer {
+	return &CoverageTracer{srcMap: s, Coverage: NewCoverage(s)}
+}
+
+func (c *CoverageTracer) CaptureTxStart(gasLimit uint64) {}
+
+func (c *CoverageTracer) CaptureTxEnd(restGas uint64) {}
+
+func (c *CoverageTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+}
+
+func (c *CoverageTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {}
+
+func (c *CoverageTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+
+func (c *CoverageTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
+
+func (c *CoverageTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	c.Coverage.Hit(pc)
+}
+
+func (c *CoverageTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
+}
+
+var _ vm.EVMLogger = (*CoverageTracer)(nil)
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// fixtureCoverage builds a small, fully synthetic SourceMap covering two
+// lines that get hit, one that doesn't, two branch points (one hit, one
+// not), and a second source prefixed "~" that must be skipped entirely.
+func fixtureCoverage() *Coverage {
+	srcMap := &SourceMap{
+		Sources: []string{"a.sol", "~unknown"},
+		PosData: [][]LineCol{
+			{{Line: 1, Col: 0}, {Line: 1, Col: 1}, {Line: 2, Col: 0}, {Line: 3, Col: 0}},
+			nil,
+		},
+		Instr: []InstrMapping{
+			{F: 0, S: 0, J: '-'}, // pc0: line 1
+			{F: 0, S: 1, J: 'i'}, // pc1: line 1, branch point (hit)
+			{F: 0, S: 2, J: '-'}, // pc2: line 2
+			{F: 0, S: 3, J: 'o'}, // pc3: line 3, branch point (never hit)
+			{F: 1, S: 0, J: '-'}, // pc4: unknown source, must be skipped
+		},
+	}
+	cov := NewCoverage(srcMap)
+	cov.Hit(0)
+	cov.Hit(1)
+	cov.Hit(2)
+	return cov
+}
+
+func TestWriteLCOVSkipsUnknownSourceAndReportsUnhitLinesAndBranches(t *testing.T) {
+	cov := fixtureCoverage()
+
+	var buf bytes.Buffer
+	if err := cov.WriteLCOV(&buf); err != nil {
+		t.Fatalf("WriteLCOV: %v", err)
+	}
+	out := buf.String()
+
+	if strings.Count(out, "SF:") != 1 {
+		t.Fatalf("expected exactly one SF record (the '~'-prefixed source must be skipped), got:\n%s", out)
+	}
+	if !strings.Contains(out, "SF:a.sol\n") {
+		t.Fatalf("expected SF:a.sol, got:\n%s", out)
+	}
+	if strings.Contains(out, "unknown") {
+		t.Fatalf("unknown source leaked into LCOV output:\n%s", out)
+	}
+
+	for _, want := range []string{"DA:1,2", "DA:2,1", "DA:3,0", "LH:2", "LF:3", "BRF:2", "BRH:1"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in LCOV output, got:\n%s", want, out)
+		}
+	}
+	// Branch order isn't guaranteed, but both branch points must show up,
+	// one hit once and one never hit.
+	if !strings.Contains(out, "BRDA:1,0,1,1") {
+		t.Fatalf("expected hit branch at line 1 to report count 1, got:\n%s", out)
+	}
+	if !strings.Contains(out, "BRDA:3,0,0,-") {
+		t.Fatalf("expected un-hit branch at line 3 to report '-', not be omitted, got:\n%s", out)
+	}
+	if !strings.Contains(out, "end_of_record") {
+		t.Fatalf("expected end_of_record, got:\n%s", out)
+	}
+}
+
+func TestWriteJSONSkipsUnknownSourceAndReportsUnhitLinesAndBranches(t *testing.T) {
+	cov := fixtureCoverage()
+
+	var buf bytes.Buffer
+	if err := cov.WriteJSON(&buf); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+
+	var files []coverageFileJSON
+	if err := json.Unmarshal(buf.Bytes(), &files); err != nil {
+		t.Fatalf("unmarshal: %v (output: %s)", err, buf.String())
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected exactly one file ('~'-prefixed source skipped), got %d: %+v", len(files), files)
+	}
+
+	f := files[0]
+	if f.Source != "a.sol" {
+		t.Fatalf("expected source a.sol, got %q", f.Source)
+	}
+	wantLines := map[uint32]uint64{1: 2, 2: 1, 3: 0}
+	for line, count := range wantLines {
+		if got, ok := f.Lines[line]; !ok || got != count {
+			t.Fatalf("line %d: got %d (present=%v), want %d", line, got, ok, count)
+		}
+	}
+	if len(f.Branches) != 2 {
+		t.Fatalf("expected 2 known branch points, got %d: %+v", len(f.Branches), f.Branches)
+	}
+	if f.Branches["1:1"] != 1 {
+		t.Fatalf("expected branch 1:1 (hit) to report count 1, got %d", f.Branches["1:1"])
+	}
+	if f.Branches["3:0"] != 0 {
+		t.Fatalf("expected branch 3:0 (never hit) to report count 0, got %d", f.Branches["3:0"])
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"math/big"
@@ -106,9 +107,50 @@ func (s *SourceMap) FormattedInfo(pc uint64) string {
 	return fmt.Sprintf("%s:%d:%d %v", f, l, c, s.Instr[pc])
 }
 
+// SourceLoader opens a source by the name it appears under in the
+// sourcemap's Sources list. The default loader used by ParseSourceMap
+// reads it as a filesystem path.
+type SourceLoader func(name string) (io.Reader, error)
+
+// sourceMapConfig holds the options ParseSourceMap accepts, built up by
+// SourceMapOption funcs.
+type sourceMapConfig struct {
+	loader SourceLoader
+}
+
+type SourceMapOption func(*sourceMapConfig)
+
+// WithSourceLoader overrides how ParseSourceMap reads each source name,
+// e.g. to pull sources out of a Hardhat/Foundry combined-json artifact
+// instead of the filesystem.
+func WithSourceLoader(loader SourceLoader) SourceMapOption {
+	return func(c *sourceMapConfig) { c.loader = loader }
+}
+
+// WithSources provides source contents in memory, keyed by the same name
+// they appear under in the sourcemap's Sources list, so callers that
+// already have the source text loaded don't need to materialize temp
+// files just to call ParseSourceMap.
+func WithSources(data map[string][]byte) SourceMapOption {
+	return WithSourceLoader(func(name string) (io.Reader, error) {
+		dat, ok := data[name]
+		if !ok {
+			return nil, fmt.Errorf("no source data provided for %q", name)
+		}
+		return bytes.NewReader(dat), nil
+	})
+}
+
 // ParseSourceMap parses a solidity sourcemap: mapping bytecode indices to source references.
 // See https://docs.soliditylang.org/en/latest/internals/source_mappings.html
-func ParseSourceMap(sources []string, bytecode []byte, sourceMap string) (*SourceMap, error) {
+func ParseSourceMap(sources []string, bytecode []byte, sourceMap string, opts ...SourceMapOption) (*SourceMap, error) {
+	cfg := &sourceMapConfig{
+		loader: func(name string) (io.Reader, error) { return os.Open(name) },
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
 	instructions := strings.Split(sourceMap, ";")
 
 	srcMap := &SourceMap{
@@ -122,20 +164,27 @@ func ParseSourceMap(sources []string, bytecode []byte, sourceMap string) (*Sourc
 			srcMap.PosData = append(srcMap.PosData, nil)
 			continue
 		}
-		dat, err := os.ReadFile(s)
+		r, err := cfg.loader(s)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open source %d %q: %w", i, s, err)
+		}
+		dat, err := io.ReadAll(r)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read source %d %q: %w", i, s, err)
 		}
-		datStr := string(dat)
 
-		out := make([]LineCol, len(datStr))
+		// Solidity indexes source offsets by UTF-8 byte offset, so we walk
+		// dat byte-by-byte here: ranging over a string yields rune start
+		// indices, which leaves holes in out for multibyte runes and
+		// misaligns every offset that follows one.
+		out := make([]LineCol, len(dat))
 		line := uint32(1)
 		lastLinePos := uint32(0)
-		for i, b := range datStr { // iterate the utf8 or the bytes?
+		for i := 0; i < len(dat); i++ {
 			col := uint32(i) - lastLinePos
 			out[i] = LineCol{Line: line, Col: col}
-			if b == '\n' {
-				lastLinePos = uint32(i)
+			if dat[i] == '\n' {
+				lastLinePos = uint32(i) + 1
 				line += 1
 			}
 		}
@@ -177,12 +226,33 @@ func ParseSourceMap(sources []string, bytecode []byte, sourceMap string) (*Sourc
 }
 
 func (s *SourceMap) Tracer(out io.Writer) *SourceMapTracer {
-	return &SourceMapTracer{s, out}
+	return &SourceMapTracer{srcMap: s, out: out}
+}
+
+// Frame is a single entry of a reconstructed Solidity call stack: either an
+// internal function frame (pushed/popped via the J jump-type field) or the
+// frame at the top representing the instruction currently executing.
+type Frame struct {
+	Source        string
+	Line          uint32
+	Col           uint32
+	ModifierDepth int32
+	JumpType      byte
+}
+
+// callScope tracks the internal (JUMP-based) frames pushed within a single
+// EVM message call, so a CALL/RETURN boundary (CaptureEnter/CaptureExit)
+// cannot leak frames across message frames.
+type callScope struct {
+	frames []Frame
 }
 
 type SourceMapTracer struct {
 	srcMap *SourceMap
 	out    io.Writer
+
+	// scopes holds one callScope per EVM message depth, outermost first.
+	scopes []*callScope
 }
 
 func (s *SourceMapTracer) CaptureTxStart(gasLimit uint64) {}
@@ -190,21 +260,70 @@ func (s *SourceMapTracer) CaptureTxStart(gasLimit uint64) {}
 func (s *SourceMapTracer) CaptureTxEnd(restGas uint64) {}
 
 func (s *SourceMapTracer) CaptureStart(env *vm.EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+	s.scopes = []*callScope{{}}
 }
 
 func (s *SourceMapTracer) CaptureEnd(output []byte, gasUsed uint64, err error) {}
 
 func (s *SourceMapTracer) CaptureEnter(typ vm.OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+	s.scopes = append(s.scopes, &callScope{})
+}
+
+func (s *SourceMapTracer) CaptureExit(output []byte, gasUsed uint64, err error) {
+	if len(s.scopes) > 0 {
+		s.scopes = s.scopes[:len(s.scopes)-1]
+	}
 }
 
-func (s *SourceMapTracer) CaptureExit(output []byte, gasUsed uint64, err error) {}
+// top returns the callScope for the message frame currently executing,
+// creating the root scope lazily in case CaptureStart was never called.
+func (s *SourceMapTracer) top() *callScope {
+	if len(s.scopes) == 0 {
+		s.scopes = []*callScope{{}}
+	}
+	return s.scopes[len(s.scopes)-1]
+}
 
 func (s *SourceMapTracer) CaptureState(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, rData []byte, depth int, err error) {
+	instr := s.srcMap.Instr[pc]
+	source, line, col := s.srcMap.Info(pc)
+	frame := Frame{Source: source, Line: line, Col: col, ModifierDepth: instr.M, JumpType: instr.J}
+
+	cur := s.top()
+	switch instr.J {
+	case 'i':
+		cur.frames = append(cur.frames, frame)
+	case 'o':
+		if len(cur.frames) > 0 {
+			cur.frames = cur.frames[:len(cur.frames)-1]
+		}
+	}
+
 	fmt.Fprintf(s.out, "%s: pc %x opcode %s  map %v\n", s.srcMap.FormattedInfo(pc), pc, op.String(), s.srcMap.Instr[pc])
 }
 
+// Backtrace reconstructs the logical Solidity call stack at pc, ordered
+// outermost (the entry message call) to innermost (the instruction at pc).
+// Frames from completed EVM message calls are not included, only the scopes
+// still open on the path down to pc.
+func (s *SourceMapTracer) Backtrace(pc uint64) []Frame {
+	var out []Frame
+	for _, sc := range s.scopes {
+		out = append(out, sc.frames...)
+	}
+	source, line, col := s.srcMap.Info(pc)
+	instr := s.srcMap.Instr[pc]
+	out = append(out, Frame{Source: source, Line: line, Col: col, ModifierDepth: instr.M, JumpType: instr.J})
+	return out
+}
+
 func (s *SourceMapTracer) CaptureFault(pc uint64, op vm.OpCode, gas, cost uint64, scope *vm.ScopeContext, depth int, err error) {
-	fmt.Fprintf(s.out, "%s: FAULT %v\n", s.srcMap.FormattedInfo(pc), err)
+	fmt.Fprintf(s.out, "FAULT %v\n", err)
+	bt := s.Backtrace(pc)
+	for i, f := range bt {
+		indent := strings.Repeat("  ", i)
+		fmt.Fprintf(s.out, "%sat %s:%d:%d (modifierDepth=%d jump=%c)\n", indent, f.Source, f.Line, f.Col, f.ModifierDepth, f.JumpType)
+	}
 }
 
 var _ vm.EVMLogger = (*SourceMapTracer)(nil)
\ No newline at end of file
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+// TestParseSourceMapPosDataUTF8 guards against the rune/byte-offset bug in
+// the PosData builder: ranging over a string yields rune start indices, so
+// a multibyte identifier used to leave holes in PosData and shift every
+// line/col pair that followed it.
+func TestParseSourceMapPosDataUTF8(t *testing.T) {
+	// "é" is 2 bytes (0xc3 0xa9); Solidity source maps index by byte
+	// offset, so PosData must have one entry per byte, not per rune.
+	src := "h\xc3\xa9llo\nworld"
+
+	srcMap, err := ParseSourceMap([]string{"a.sol"}, []byte{}, "", WithSources(map[string][]byte{
+		"a.sol": []byte(src),
+	}))
+	if err != nil {
+		t.Fatalf("ParseSourceMap: %v", err)
+	}
+
+	posData := srcMap.PosData[0]
+	if len(posData) != len(src) {
+		t.Fatalf("expected one PosData entry per byte (%d), got %d", len(src), len(posData))
+	}
+	for i, lc := range posData {
+		if lc.Line == 0 {
+			t.Fatalf("PosData[%d] was never populated (rune-iteration hole)", i)
+		}
+	}
+
+	nlOffset := len("h\xc3\xa9llo")
+	if posData[nlOffset].Line != 1 {
+		t.Fatalf("expected the newline byte at offset %d to still be on line 1, got %d", nlOffset, posData[nlOffset].Line)
+	}
+	wOffset := nlOffset + 1
+	if posData[wOffset].Line != 2 || posData[wOffset].Col != 0 {
+		t.Fatalf("expected 'world' to start at line 2 col 0, got line %d col %d", posData[wOffset].Line, posData[wOffset].Col)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/core/vm"
+)
+
+// StepHash is a digest summarizing the observable state at one step of an
+// execution trace: register file plus memory, for the MIPS side, or PC
+// plus stack/memory, for the EVM side.
+type StepHash [32]byte
+
+// StepHasher is a step-indexed execution trace that can answer "what was
+// the state hash at step N". Implementations are free to compute it
+// on-demand, which is what lets UnicornTrace seek via snapshot+replay
+// instead of keeping every step in memory.
+type StepHasher interface {
+	// StateHash returns the state hash at step, or ok=false if the trace
+	// does not extend that far.
+	StateHash(step uint64) (hash StepHash, ok bool, err error)
+}
+
+// EVMTrace is a StepHasher backed by a flat, pre-recorded slice of hashes,
+// e.g. one HashEVMState result per step of a replayed EVM transaction.
+type EVMTrace struct {
+	Hashes []StepHash
+}
+
+func (t *EVMTrace) StateHash(step uint64) (StepHash, bool, error) {
+	if step >= uint64(len(t.Hashes)) {
+		return StepHash{}, false, nil
+	}
+	return t.Hashes[step], true, nil
+}
+
+// HashEVMState hashes the parts of EVM execution state that must match the
+// MIPS-emulated equivalent for a step to be considered in agreement: the
+// current pc/op and the stack and memory contents.
+func HashEVMState(pc uint64, op vm.OpCode, scope *vm.ScopeContext) StepHash {
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, pc)
+	binary.Write(h, binary.BigEndian, byte(op))
+	if scope != nil {
+		for _, w := range scope.Stack.Data() {
+			b := w.Bytes32()
+			h.Write(b[:])
+		}
+		h.Write(scope.Memory.Data())
+	}
+	var out StepHash
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// UnicornTrace is a StepHasher over a UnicornVM, backed by a sparse set of
+// snapshots rather than one hash per step: seeking to an arbitrary step
+// restores the nearest earlier snapshot and replays the remaining steps,
+// which is what makes bisection over billions of MIPS steps tractable.
+type UnicornTrace struct {
+	vm        *UnicornVM
+	snapshots []*State // ordered by Step, ascending
+}
+
+// NewUnicornTrace snapshots v at step 0, then drives v forward
+// snapshotEvery steps at a time, taking a snapshot after each Step, until
+// a Step returns an error. v is left at the end of that run.
+func NewUnicornTrace(v *UnicornVM, snapshotEvery uint64) (*UnicornTrace, error) {
+	t := &UnicornTrace{vm: v}
+	first, err := v.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	t.snapshots = append(t.snapshots, first)
+
+	for {
+		if err := v.Step(snapshotEvery); err != nil {
+			break // ran off the end of the program; trace stops here
+		}
+		snap, err := v.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+		t.snapshots = append(t.snapshots, snap)
+	}
+	return t, nil
+}
+
+// StateHash seeks to step via SeekTo — replaying every snapshot's page
+// diff in order up to the one at or before step, not just that single
+// snapshot — then hashes the register file and current memory. A plain
+// Restore of the nearest snapshot is not enough here: by the time
+// NewUnicornTrace finishes, the VM's memory holds the *last* step's
+// contents, so restoring one intermediate snapshot would leave every page
+// dirtied outside that snapshot's interval at its final-step value.
+func (t *UnicornTrace) StateHash(step uint64) (StepHash, bool, error) {
+	last := t.snapshots[len(t.snapshots)-1]
+	if step > last.Step {
+		return StepHash{}, false, nil
+	}
+	if err := t.vm.SeekTo(t.snapshots, step); err != nil {
+		return StepHash{}, false, err
+	}
+	h, err := t.hashCurrentState()
+	if err != nil {
+		return StepHash{}, false, err
+	}
+	return h, true, nil
+}
+
+func (t *UnicornTrace) hashCurrentState() (StepHash, error) {
+	snap, err := t.vm.Snapshot()
+	if err != nil {
+		return StepHash{}, err
+	}
+	h := sha256.New()
+	for _, r := range snap.Registers {
+		binary.Write(h, binary.BigEndian, r)
+	}
+	binary.Write(h, binary.BigEndian, snap.LO)
+	binary.Write(h, binary.BigEndian, snap.HI)
+	binary.Write(h, binary.BigEndian, snap.PC)
+	mem, err := t.vm.mu.MemRead(0, memSize)
+	if err != nil {
+		return StepHash{}, err
+	}
+	h.Write(mem)
+	var out StepHash
+	copy(out[:], h.Sum(nil))
+	return out, nil
+}
+
+// BisectDivergence locates the first step at which mips and evm disagree,
+// given a range [lo, hi] where step lo is known to agree and step hi is
+// known to diverge (or to be the last step either trace has). It costs
+// O(log(hi-lo)) StateHash calls instead of a linear scan, which is what
+// makes comparing traces with billions of steps tractable.
+func BisectDivergence(mips StepHasher, evm StepHasher, lo, hi uint64) (uint64, error) {
+	if hi <= lo {
+		return 0, fmt.Errorf("invalid bisect range: lo=%d hi=%d", lo, hi)
+	}
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		mh, mok, err := mips.StateHash(mid)
+		if err != nil {
+			return 0, fmt.Errorf("failed to hash mips state at step %d: %w", mid, err)
+		}
+		eh, eok, err := evm.StateHash(mid)
+		if err != nil {
+			return 0, fmt.Errorf("failed to hash evm state at step %d: %w", mid, err)
+		}
+		if mok && eok && mh == eh {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return hi, nil
+}
+
+// TraceBisect is the library entry point for divergence bisection: it builds
+// a snapshot-backed trace over the MIPS program at fn, bisects it against
+// the already-recorded evmTrace, and reports the first diverging step.
+func TraceBisect(fn string, snapshotEvery uint64, evmTrace *EVMTrace) (uint64, error) {
+	if len(evmTrace.Hashes) == 0 {
+		return 0, fmt.Errorf("evm trace has no recorded steps")
+	}
+	v, err := NewUnicornVM(fn)
+	if err != nil {
+		return 0, err
+	}
+	mipsTrace, err := NewUnicornTrace(v, snapshotEvery)
+	if err != nil {
+		return 0, err
+	}
+	hi := uint64(len(evmTrace.Hashes)) - 1
+	return BisectDivergence(mipsTrace, evmTrace, 0, hi)
+}
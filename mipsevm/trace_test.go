@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeTrace is a StepHasher over a fixed, pre-recorded slice of hashes, for
+// exercising BisectDivergence without a real EVM or UnicornVM.
+type fakeTrace struct {
+	hashes []StepHash
+}
+
+func (f *fakeTrace) StateHash(step uint64) (StepHash, bool, error) {
+	if step >= uint64(len(f.hashes)) {
+		return StepHash{}, false, nil
+	}
+	return f.hashes[step], true, nil
+}
+
+// TestBisectDivergenceFindsFirstMismatch checks that bisection converges on
+// the exact first diverging step, not just some step past it.
+func TestBisectDivergenceFindsFirstMismatch(t *testing.T) {
+	const n = 10
+	const divergeAt = 6
+
+	a := &fakeTrace{hashes: make([]StepHash, n)}
+	b := &fakeTrace{hashes: make([]StepHash, n)}
+	for i := 0; i < n; i++ {
+		a.hashes[i] = StepHash{byte(i)}
+		b.hashes[i] = StepHash{byte(i)}
+	}
+	for i := divergeAt; i < n; i++ {
+		b.hashes[i] = StepHash{0xff, byte(i)}
+	}
+
+	got, err := BisectDivergence(a, b, 0, uint64(n-1))
+	if err != nil {
+		t.Fatalf("BisectDivergence: %v", err)
+	}
+	if got != divergeAt {
+		t.Fatalf("expected first divergence at step %d, got %d", divergeAt, got)
+	}
+}
+
+// TestBisectDivergenceRejectsEmptyRange guards against the lo==hi
+// degenerate case silently returning a meaningless answer.
+func TestBisectDivergenceRejectsEmptyRange(t *testing.T) {
+	a := &fakeTrace{}
+	if _, err := BisectDivergence(a, a, 5, 5); err == nil {
+		t.Fatalf("expected an error when lo == hi")
+	}
+}
+
+// writeMIPSCounterProgram writes a tiny big-endian MIPS program that
+// repeatedly executes "addiu $t0, $t0, 1", so after n steps register $t0
+// holds n. It then jumps to the unmapped exit address 0xdead0000, so the
+// next Step fails there instead of running on through zeroed memory (which
+// decodes as NOPs) and NewUnicornTrace stops. It exists purely to give
+// NewUnicornVM/UnicornTrace something deterministic to step through below.
+func writeMIPSCounterProgram(t *testing.T, n int) string {
+	t.Helper()
+	const addiuT0T0One = 0x25080001 // addiu $t0, $t0, 1 (opcode 9, rs=$t0, rt=$t0, imm=1)
+	const luiT1Dead = 0x3c09dead    // lui $t1, 0xdead
+	const jrT1 = 0x01200008         // jr $t1 (delay slot follows)
+
+	buf := make([]byte, 4*(n+3))
+	for i := 0; i < n; i++ {
+		binary.BigEndian.PutUint32(buf[i*4:], addiuT0T0One)
+	}
+	binary.BigEndian.PutUint32(buf[n*4:], luiT1Dead)
+	binary.BigEndian.PutUint32(buf[(n+1)*4:], jrT1)
+	// buf[(n+2)*4:] stays zero: a NOP in jr's delay slot.
+
+	fn := filepath.Join(t.TempDir(), "counter.bin")
+	if err := os.WriteFile(fn, buf, 0o644); err != nil {
+		t.Fatalf("writing test MIPS program: %v", err)
+	}
+	return fn
+}
+
+// linearReplayHash runs a fresh VM forward from genesis to step and hashes
+// its state the same way UnicornTrace does, as the ground truth that
+// StateHash-via-SeekTo is checked against.
+func linearReplayHash(t *testing.T, fn string, step uint64) StepHash {
+	t.Helper()
+	v, err := NewUnicornVM(fn)
+	if err != nil {
+		t.Fatalf("NewUnicornVM: %v", err)
+	}
+	if step > 0 {
+		if err := v.Step(step); err != nil {
+			t.Fatalf("Step(%d): %v", step, err)
+		}
+	}
+	h, err := (&UnicornTrace{vm: v}).hashCurrentState()
+	if err != nil {
+		t.Fatalf("hashCurrentState: %v", err)
+	}
+	return h
+}
+
+// TestUnicornTraceSeekMatchesLinearReplay checks that seeking a
+// UnicornTrace to an arbitrary step — restoring a snapshot and replaying
+// every earlier snapshot's page diff via SeekTo — produces the same state
+// hash as running a fresh VM forward from genesis to that same step
+// directly. This is exactly the scenario the chunk0-3 genesis-dirty-page
+// fix and SeekTo exist to get right: NewUnicornTrace drives the one
+// shared VM to the end of the program before any StateHash call seeks
+// backward into it.
+func TestUnicornTraceSeekMatchesLinearReplay(t *testing.T) {
+	const programLen = 32
+	const snapshotEvery = 4
+
+	fn := writeMIPSCounterProgram(t, programLen)
+
+	v, err := NewUnicornVM(fn)
+	if err != nil {
+		t.Fatalf("NewUnicornVM: %v", err)
+	}
+	trace, err := NewUnicornTrace(v, snapshotEvery)
+	if err != nil {
+		t.Fatalf("NewUnicornTrace: %v", err)
+	}
+
+	for _, step := range []uint64{0, 1, 3, 4, 7, 12, 19, uint64(programLen - 1)} {
+		got, ok, err := trace.StateHash(step)
+		if err != nil {
+			t.Fatalf("StateHash(%d): %v", step, err)
+		}
+		if !ok {
+			t.Fatalf("StateHash(%d): expected ok=true", step)
+		}
+
+		want := linearReplayHash(t, fn, step)
+		if got != want {
+			t.Fatalf("StateHash(%d) = %x, want %x (linear replay)", step, got, want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -16,62 +18,364 @@ func check(err error) {
 	}
 }
 
-var steps int = 0
-var heap_start uint64 = 0
+const (
+	memSize  = 0x80000000 // 2 GiB MIPS memory map
+	pageSize = 0x1000      // 4 KiB, matches the dirty-tracking granularity
+)
 
-func RegRead(u *uc.Unicorn, reg int) {
+// mipsRegs lists the 32 general purpose registers tracked by a snapshot.
+// PC, HI and LO are also tracked, but are read and written separately.
+var mipsRegs = [32]int{
+	uc.MIPS_REG_ZERO, uc.MIPS_REG_AT, uc.MIPS_REG_V0, uc.MIPS_REG_V1,
+	uc.MIPS_REG_A0, uc.MIPS_REG_A1, uc.MIPS_REG_A2, uc.MIPS_REG_A3,
+	uc.MIPS_REG_T0, uc.MIPS_REG_T1, uc.MIPS_REG_T2, uc.MIPS_REG_T3,
+	uc.MIPS_REG_T4, uc.MIPS_REG_T5, uc.MIPS_REG_T6, uc.MIPS_REG_T7,
+	uc.MIPS_REG_S0, uc.MIPS_REG_S1, uc.MIPS_REG_S2, uc.MIPS_REG_S3,
+	uc.MIPS_REG_S4, uc.MIPS_REG_S5, uc.MIPS_REG_S6, uc.MIPS_REG_S7,
+	uc.MIPS_REG_T8, uc.MIPS_REG_T9, uc.MIPS_REG_K0, uc.MIPS_REG_K1,
+	uc.MIPS_REG_GP, uc.MIPS_REG_SP, uc.MIPS_REG_FP, uc.MIPS_REG_RA,
+}
 
+// State is a checkpoint of a UnicornVM: the full register file, the brk
+// pointer, the step counter, and the memory pages written since the
+// previous Snapshot. It is intentionally a diff, not a full memory image:
+// replaying a sequence of States from genesis reconstructs the full state
+// without ever materializing the whole 2 GiB address space on disk.
+type State struct {
+	Registers [32]uint32
+	LO, HI    uint32
+	PC        uint32
+	HeapStart uint64
+	Step      uint64
+	// Pages maps a 4 KiB page index to its contents, for pages written
+	// since the snapshot this State was diffed against.
+	Pages map[uint32][pageSize]byte
 }
 
-func RunUnicorn(fn string) {
+// MarshalBinary encodes a State as: a fixed header (registers, LO, HI, PC,
+// heap pointer, step counter), a page count, then that many
+// (page_index uint32, page_bytes [4096]byte) records.
+func (st *State) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, r := range st.Registers {
+		if err := binary.Write(buf, binary.BigEndian, r); err != nil {
+			return nil, err
+		}
+	}
+	if err := binary.Write(buf, binary.BigEndian, st.LO); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, st.HI); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, st.PC); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, st.HeapStart); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, st.Step); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint32(len(st.Pages))); err != nil {
+		return nil, err
+	}
+	// map iteration order is unspecified, but decode doesn't care about
+	// page order, only that every (index, bytes) pair round-trips.
+	for idx, page := range st.Pages {
+		if err := binary.Write(buf, binary.BigEndian, idx); err != nil {
+			return nil, err
+		}
+		if _, err := buf.Write(page[:]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (st *State) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	for i := range st.Registers {
+		if err := binary.Read(r, binary.BigEndian, &st.Registers[i]); err != nil {
+			return err
+		}
+	}
+	if err := binary.Read(r, binary.BigEndian, &st.LO); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &st.HI); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &st.PC); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &st.HeapStart); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.BigEndian, &st.Step); err != nil {
+		return err
+	}
+	var numPages uint32
+	if err := binary.Read(r, binary.BigEndian, &numPages); err != nil {
+		return err
+	}
+	st.Pages = make(map[uint32][pageSize]byte, numPages)
+	for i := uint32(0); i < numPages; i++ {
+		var idx uint32
+		if err := binary.Read(r, binary.BigEndian, &idx); err != nil {
+			return err
+		}
+		var page [pageSize]byte
+		if _, err := r.Read(page[:]); err != nil {
+			return fmt.Errorf("failed to read page %d data: %w", idx, err)
+		}
+		st.Pages[idx] = page
+	}
+	return nil
+}
+
+// UnicornVM wraps a Unicorn MIPS instance with the bookkeeping needed to
+// checkpoint and resume execution: a step counter, the brk pointer, and a
+// set of dirty pages tracked since the last Snapshot.
+type UnicornVM struct {
+	mu        uc.Unicorn
+	steps     uint64
+	heapStart uint64
+	dirty     map[uint32]bool
+
+	start time.Time
+}
+
+// NewUnicornVM copies the raw MIPS binary image at fn, byte for byte, into a
+// fresh Unicorn instance at address 0, wiring up the same syscall emulation and
+// step-counting hooks RunUnicorn used, plus a HOOK_MEM_WRITE hook that
+// marks pages dirty for Snapshot.
+func NewUnicornVM(fn string) (*UnicornVM, error) {
 	mu, err := uc.NewUnicorn(uc.ARCH_MIPS, uc.MODE_32|uc.MODE_BIG_ENDIAN)
-	check(err)
+	if err != nil {
+		return nil, err
+	}
+	v := &UnicornVM{mu: mu, dirty: make(map[uint32]bool), start: time.Now()}
 
 	mu.HookAdd(uc.HOOK_INTR, func(mu uc.Unicorn, intno uint32) {
 		if intno != 17 {
-			log.Fatal("invalid interrupt ", intno, " at step ", steps)
+			log.Fatal("invalid interrupt ", intno, " at step ", v.steps)
 		}
-		syscall_no, _ := mu.RegRead(uc.MIPS_REG_V0)
+		syscallNo, _ := mu.RegRead(uc.MIPS_REG_V0)
 		v0 := uint64(0)
-		if syscall_no == 4004 {
+		if syscallNo == 4004 {
 			buf, _ := mu.RegRead(uc.MIPS_REG_A1)
 			count, _ := mu.RegRead(uc.MIPS_REG_A2)
 			bytes, _ := mu.MemRead(buf, count)
 			os.Stderr.Write(bytes)
-		} else if syscall_no == 4090 {
+		} else if syscallNo == 4090 {
 			a0, _ := mu.RegRead(uc.MIPS_REG_A0)
 			sz, _ := mu.RegRead(uc.MIPS_REG_A1)
 			if a0 == 0 {
-				v0 = 0x20000000 + heap_start
-				heap_start += sz
+				v0 = 0x20000000 + v.heapStart
+				v.heapStart += sz
 			} else {
 				v0 = a0
 			}
-		} else if syscall_no == 4045 {
+		} else if syscallNo == 4045 {
 			v0 = 0x40000000
-		} else if syscall_no == 4120 {
+		} else if syscallNo == 4120 {
 			v0 = 1
 		} else {
-			fmt.Println("syscall", syscall_no)
+			fmt.Println("syscall", syscallNo)
 		}
 		mu.RegWrite(uc.MIPS_REG_V0, v0)
 		mu.RegWrite(uc.MIPS_REG_A3, 0)
 	}, 1, 0)
 
-	ministart := time.Now()
 	mu.HookAdd(uc.HOOK_CODE, func(mu uc.Unicorn, addr uint64, size uint32) {
-		if steps%100000 == 0 {
-			steps_per_sec := float64(steps) * 1e9 / float64(time.Now().Sub(ministart).Nanoseconds())
-			fmt.Printf("%6d Code: 0x%x, 0x%x steps per s %f\n", steps, addr, size, steps_per_sec)
+		if v.steps%100000 == 0 {
+			stepsPerSec := float64(v.steps) * 1e9 / float64(time.Now().Sub(v.start).Nanoseconds())
+			fmt.Printf("%6d Code: 0x%x, 0x%x steps per s %f\n", v.steps, addr, size, stepsPerSec)
 		}
-		steps += 1
+		v.steps += 1
 	}, 1, 0)
 
-	check(mu.MemMap(0, 0x80000000))
+	mu.HookAdd(uc.HOOK_MEM_WRITE, func(mu uc.Unicorn, access int, addr uint64, size int, value int64) {
+		first := uint32(addr / pageSize)
+		last := uint32((addr + uint64(size) - 1) / pageSize)
+		for p := first; p <= last; p++ {
+			v.dirty[p] = true
+		}
+	}, 1, 0)
 
-	dat, _ := ioutil.ReadFile(fn)
-	mu.MemWrite(0, dat)
+	if err := mu.MemMap(0, memSize); err != nil {
+		return nil, err
+	}
 
-	mu.Start(0, 0xdead0000)
+	dat, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if err := mu.MemWrite(0, dat); err != nil {
+		return nil, err
+	}
+	// mu.MemWrite is a host-side write: it never goes through Unicorn's
+	// emulated memory-access path, so HOOK_MEM_WRITE above never fires for
+	// it and the genesis image would otherwise be invisible to dirty
+	// tracking. Mark the pages it touched dirty by hand so the first
+	// Snapshot captures a complete baseline instead of an empty one.
+	if len(dat) > 0 {
+		for p := uint32(0); p <= uint32((len(dat)-1)/pageSize); p++ {
+			v.dirty[p] = true
+		}
+	}
+
+	return v, nil
+}
 
-}
\ No newline at end of file
+// Step runs exactly n MIPS instructions from the current PC.
+func (v *UnicornVM) Step(n uint64) error {
+	pc, err := v.mu.RegRead(uc.MIPS_REG_PC)
+	if err != nil {
+		return err
+	}
+	return v.mu.StartWithOptions(pc, 0xffffffff, &uc.UcOptions{Count: n})
+}
+
+// Run executes from the current PC until untilPC is reached.
+func (v *UnicornVM) Run(untilPC uint64) error {
+	pc, err := v.mu.RegRead(uc.MIPS_REG_PC)
+	if err != nil {
+		return err
+	}
+	return v.mu.Start(pc, untilPC)
+}
+
+// Snapshot captures the current register file, the brk pointer, the step
+// counter, and the contents of every page written since the previous
+// Snapshot (or since the VM was created, for the first one). Taking a
+// snapshot resets the dirty set.
+func (v *UnicornVM) Snapshot() (*State, error) {
+	st := &State{HeapStart: v.heapStart, Step: v.steps, Pages: make(map[uint32][pageSize]byte, len(v.dirty))}
+
+	for i, reg := range mipsRegs {
+		val, err := v.mu.RegRead(reg)
+		if err != nil {
+			return nil, err
+		}
+		st.Registers[i] = uint32(val)
+	}
+	if lo, err := v.mu.RegRead(uc.MIPS_REG_LO); err != nil {
+		return nil, err
+	} else {
+		st.LO = uint32(lo)
+	}
+	if hi, err := v.mu.RegRead(uc.MIPS_REG_HI); err != nil {
+		return nil, err
+	} else {
+		st.HI = uint32(hi)
+	}
+	if pc, err := v.mu.RegRead(uc.MIPS_REG_PC); err != nil {
+		return nil, err
+	} else {
+		st.PC = uint32(pc)
+	}
+
+	for page := range v.dirty {
+		dat, err := v.mu.MemRead(uint64(page)*pageSize, pageSize)
+		if err != nil {
+			return nil, err
+		}
+		var p [pageSize]byte
+		copy(p[:], dat)
+		st.Pages[page] = p
+	}
+	v.dirty = make(map[uint32]bool)
+
+	return st, nil
+}
+
+// Restore applies a single State diff on top of the VM's current memory:
+// it writes back the register file, brk pointer and step counter, and
+// overwrites every page that State touched. Because each State only
+// carries the pages written since the *previous* Snapshot, calling
+// Restore with one State out of a longer sequence leaves every page
+// touched by any other State at whatever value the VM's memory already
+// held — callers that need to seek to an arbitrary snapshot out of a
+// sequence must use SeekTo, not call Restore directly.
+func (v *UnicornVM) Restore(st *State) error {
+	for i, reg := range mipsRegs {
+		if err := v.mu.RegWrite(reg, uint64(st.Registers[i])); err != nil {
+			return err
+		}
+	}
+	if err := v.mu.RegWrite(uc.MIPS_REG_LO, uint64(st.LO)); err != nil {
+		return err
+	}
+	if err := v.mu.RegWrite(uc.MIPS_REG_HI, uint64(st.HI)); err != nil {
+		return err
+	}
+	if err := v.mu.RegWrite(uc.MIPS_REG_PC, uint64(st.PC)); err != nil {
+		return err
+	}
+	v.heapStart = st.HeapStart
+	v.steps = st.Step
+
+	for idx, page := range st.Pages {
+		if err := v.mu.MemWrite(uint64(idx)*pageSize, page[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SeekTo reproduces the VM's state as of step, given the ordered sequence
+// of States a trace snapshotted it at (snapshots[0].Step == 0, ascending
+// thereafter). It zeroes every page held by a snapshot after the one at or
+// before step (the genesis image is all in snapshots[0], so any page not
+// written by then was still zero), then replays every snapshot's page diff
+// from snapshots[0] up to the snapshot at or before step, in order, so no
+// page keeps stale memory from whatever the VM last ran, then restores
+// that snapshot's register file and steps forward the remainder. This is
+// the only correct way to land on an arbitrary step out of a snapshot
+// sequence; a single Restore call is not enough, see Restore's doc.
+func (v *UnicornVM) SeekTo(snapshots []*State, step uint64) error {
+	idx := -1
+	for i, s := range snapshots {
+		if s.Step > step {
+			break
+		}
+		idx = i
+	}
+	if idx < 0 {
+		return fmt.Errorf("no snapshot at or before step %d", step)
+	}
+
+	var zero [pageSize]byte
+	for i := idx + 1; i < len(snapshots); i++ {
+		for pidx := range snapshots[i].Pages {
+			if err := v.mu.MemWrite(uint64(pidx)*pageSize, zero[:]); err != nil {
+				return err
+			}
+		}
+	}
+	for i := 0; i < idx; i++ {
+		for pidx, page := range snapshots[i].Pages {
+			if err := v.mu.MemWrite(uint64(pidx)*pageSize, page[:]); err != nil {
+				return err
+			}
+		}
+	}
+	if err := v.Restore(snapshots[idx]); err != nil {
+		return err
+	}
+
+	if remaining := step - snapshots[idx].Step; remaining > 0 {
+		return v.Step(remaining)
+	}
+	return nil
+}
+
+// RunUnicorn preserves the original entry point: load fn and run it to
+// completion.
+func RunUnicorn(fn string) {
+	v, err := NewUnicornVM(fn)
+	check(err)
+	check(v.Run(0xdead0000))
+}
@@ -0,0 +1,49 @@
+package main
+
+import "testing"
+
+// TestStateMarshalUnmarshalRoundTrip checks that a State survives the
+// MarshalBinary/UnmarshalBinary round trip used to checkpoint a
+// UnicornVM to disk: registers, scalars, and dirty page contents must all
+// come back unchanged.
+func TestStateMarshalUnmarshalRoundTrip(t *testing.T) {
+	var page [pageSize]byte
+	page[0] = 0xab
+	page[pageSize-1] = 0xcd
+
+	want := &State{
+		Registers: [32]uint32{1, 2, 3, 0xdeadbeef},
+		LO:        4,
+		HI:        5,
+		PC:        0x1000,
+		HeapStart: 0x2000,
+		Step:      42,
+		Pages:     map[uint32][pageSize]byte{7: page},
+	}
+
+	data, err := want.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+
+	got := &State{}
+	if err := got.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+
+	if got.Registers != want.Registers {
+		t.Fatalf("Registers mismatch: got %v, want %v", got.Registers, want.Registers)
+	}
+	if got.LO != want.LO || got.HI != want.HI || got.PC != want.PC {
+		t.Fatalf("LO/HI/PC mismatch: got %d/%d/%d, want %d/%d/%d", got.LO, got.HI, got.PC, want.LO, want.HI, want.PC)
+	}
+	if got.HeapStart != want.HeapStart || got.Step != want.Step {
+		t.Fatalf("HeapStart/Step mismatch: got %d/%d, want %d/%d", got.HeapStart, got.Step, want.HeapStart, want.Step)
+	}
+	if len(got.Pages) != len(want.Pages) {
+		t.Fatalf("expected %d pages, got %d", len(want.Pages), len(got.Pages))
+	}
+	if got.Pages[7] != want.Pages[7] {
+		t.Fatalf("page 7 contents changed across the round trip")
+	}
+}